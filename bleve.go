@@ -6,24 +6,95 @@
 package alexandria
 
 import (
+	"context"
 	"io/ioutil"
 	"log"
 	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/blevesearch/bleve"
 	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
 	"github.com/blevesearch/bleve/analysis/analyzer/simple"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/gobwas/glob"
 	"github.com/pkg/errors"
 )
 
+// supportedLanguages are the languages detectLanguage can recognise, and the
+// names of the bleve analyzers used to index each one's content variant.
+var supportedLanguages = []string{"en", "de", "fr", "es", "it", "nl"}
+
+// stopWords is a handful of very common words per supported language, used by
+// detectLanguage to guess what language a scroll is written in without
+// pulling in a full n-gram classifier.
+var stopWords = map[string][]string{
+	"en": {"the", "and", "of", "to", "in", "is", "that", "it", "for", "with"},
+	"de": {"der", "die", "das", "und", "ist", "von", "mit", "nicht", "ein", "eine"},
+	"fr": {"le", "la", "les", "et", "de", "des", "est", "une", "dans", "pour"},
+	"es": {"el", "la", "los", "las", "de", "que", "es", "una", "con", "para"},
+	"it": {"il", "la", "di", "che", "un", "una", "per", "con", "non", "gli"},
+	"nl": {"de", "het", "een", "van", "en", "dat", "niet", "met", "voor", "is"},
+}
+
+// detectLanguage guesses the natural language a scroll is written in by
+// counting stop-word occurrences per language and picking the highest
+// scorer. It falls back to "en" when no stop word matches, preserving the
+// behaviour from before per-language indexing was introduced.
+func detectLanguage(content string) string {
+	counts := make(map[string]int, len(supportedLanguages))
+	for _, word := range strings.Fields(strings.ToLower(content)) {
+		word = strings.Trim(word, ".,;:!?()[]{}\"'")
+		for lang, words := range stopWords {
+			for _, stopWord := range words {
+				if word == stopWord {
+					counts[lang]++
+				}
+			}
+		}
+	}
+
+	best := "en"
+	bestCount := 0
+	for _, lang := range supportedLanguages {
+		if counts[lang] > bestCount {
+			best = lang
+			bestCount = counts[lang]
+		}
+	}
+	return best
+}
+
 // UpdateIndex adds all documents to the index that have been created or
 // modified since the last time this function was executed.
 //
 // Note that this function does *not* remove deleted documents from the index.
 // See `RemoveFromIndex`.
 func updateIndex() error {
+	return updateIndexCtx(context.Background())
+}
+
+// parsedScroll is a unit of work handed from the producer goroutine in
+// updateIndexCtx to its indexing workers.
+type parsedScroll struct {
+	id     string
+	scroll Scroll
+}
+
+// updateIndexCtx is the context-cancellable implementation behind
+// updateIndex. One producer goroutine walks Config.KnowledgeDirectory and
+// parses scrolls onto a buffered channel; Config.MaxProcs workers each
+// accumulate a sub-batch of up to Config.BatchSize documents and commit it
+// whenever it fills up or a flush ticker fires, persisting index_updated
+// after every commit so a crash only loses the most recent, uncommitted
+// batch. Cancelling ctx stops the run after the in-flight batches are
+// flushed, letting e.g. the web server abort a reindex on shutdown.
+func updateIndexCtx(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	index, isNewIndex, err := openOrCreateIndex()
 	if err != nil {
 		return errors.Wrap(err, "open or create index")
@@ -38,55 +109,300 @@ func updateIndex() error {
 	// documents we reindex. Therefore, the worst case scenario when
 	// getModTime fails is that we do some redundant work.
 	tryLogError(err)
-	recordIndexUpdateStart(indexUpdateFile)
 
 	files, err := ioutil.ReadDir(Config.KnowledgeDirectory)
 	if err != nil {
 		return errors.Wrap(err, "read knowledge directory")
 	}
 
-	batch := index.NewBatch()
-	for _, file := range files {
-		if !isNewIndex && isOlderThan(file, timeOfLastIndexUpdate) {
+	filter, err := newScrollFilter()
+	if err != nil {
+		return errors.Wrap(err, "compile indexer include/exclude filters")
+	}
+
+	scrolls := make(chan parsedScroll, Config.BatchSize)
+	go produceScrollsToIndex(ctx, index, files, filter, isNewIndex, timeOfLastIndexUpdate, scrolls)
+
+	var indexed int64
+	start := time.Now()
+
+	// Every successful batch stamps index_updated with the time this run
+	// started, not the time the batch committed. A scroll edited while a
+	// long run is still in progress must stay newer than the watermark, or
+	// the next run would skip it forever.
+	workers := Config.MaxProcs
+	if workers < 1 {
+		workers = 1
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := indexWorker(ctx, index, scrolls, indexUpdateFile, &indexed, start); err != nil {
+				// Unblock produceScrollsToIndex (and any sibling workers)
+				// immediately instead of leaving them stuck sending into a
+				// channel nobody is reading from anymore.
+				cancel()
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// Every worker that indexWorker's ctx.Done() branch unblocks after
+	// cancel() also reports ctx.Err() ("context canceled") here, racing the
+	// real failure that triggered the cancellation for which error "range"
+	// happens to read first. Only surface a cascade error if no worker
+	// reported the actual failure.
+	var cascadeErr error
+	for err := range errs {
+		if errors.Is(err, context.Canceled) {
+			cascadeErr = err
 			continue
 		}
+		return err
+	}
+	return cascadeErr
+}
+
+// produceScrollsToIndex walks files, drops entries that Config.IndexerInclude
+// / Config.IndexerExclude / Config.MaxFileSize now exclude (removing any
+// stale index entry for them), skips documents that are already up to date,
+// and ships everything else to out for the indexing workers to batch up.
+//
+// Deletions go through index directly rather than through removeFromIndex,
+// which opens its own handle on the same bleve path: scorch takes an
+// exclusive, non-blocking flock with retry-forever semantics, so opening a
+// second handle while updateIndexCtx's index is still open here would hang
+// this goroutine -- and with it the whole indexing pipeline, since the
+// workers downstream would starve waiting on a channel nothing is feeding
+// anymore -- the first time a file actually needs excluding during a
+// reindex.
+func produceScrollsToIndex(ctx context.Context, index bleve.Index, files []os.FileInfo, filter scrollFilter, isNewIndex bool, since int64, out chan<- parsedScroll) {
+	defer close(out)
 
+	for _, file := range files {
 		id := strings.TrimSuffix(file.Name(), ".tex")
+		if !filter.allows(file) {
+			tryLogError(index.Delete(id))
+			continue
+		}
+
+		if !isNewIndex && isOlderThan(file, since) {
+			continue
+		}
+
 		scroll, err := loadAndParseScrollContent(id, file)
 		if err != nil {
 			logError(err)
 			continue
 		}
-		err = batch.Index(id, scroll)
+
+		select {
+		case out <- parsedScroll{id, scroll}:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// indexWorker accumulates parsed scrolls from in into a batch, committing it
+// to index whenever it reaches Config.BatchSize documents or
+// Config.BatchFlushInterval elapses, and logs progress every
+// Config.ProgressLogInterval documents via the shared indexed counter.
+func indexWorker(ctx context.Context, index bleve.Index, in <-chan parsedScroll, indexUpdateFile string, indexed *int64, start time.Time) error {
+	batch := index.NewBatch()
+
+	flushInterval := Config.BatchFlushInterval
+	if flushInterval <= 0 {
+		flushInterval = 5 * time.Second
+	}
+	flush := time.NewTicker(flushInterval)
+	defer flush.Stop()
+
+	commit := func() error {
+		if batch.Size() == 0 {
+			return nil
+		}
+		if err := index.Batch(batch); err != nil {
+			return errors.Wrap(err, "commit batch")
+		}
+		tryLogError(touchAt(indexUpdateFile, start))
+		batch.Reset()
+		return nil
+	}
+
+	for {
+		select {
+		case scroll, ok := <-in:
+			if !ok {
+				return commit()
+			}
+
+			if err := batch.Index(scroll.id, scroll.scroll); err != nil {
+				logError(err)
+				continue
+			}
+
+			n := atomic.AddInt64(indexed, 1)
+			if Config.ProgressLogInterval > 0 && n%int64(Config.ProgressLogInterval) == 0 {
+				log.Printf("indexed=%d,elapsed_ms=%d", n, time.Since(start)/time.Millisecond)
+			}
+
+			if batch.Size() >= Config.BatchSize {
+				if err := commit(); err != nil {
+					return err
+				}
+			}
+		case <-flush.C:
+			if err := commit(); err != nil {
+				return err
+			}
+		case <-ctx.Done():
+			tryLogError(commit())
+			return ctx.Err()
+		}
+	}
+}
+
+// scrollFilter decides which files in the knowledge directory are eligible
+// for indexing or rendering, based on Config.IndexerInclude,
+// Config.IndexerExclude and Config.MaxFileSize.
+//
+// Config.KnowledgeDirectory is read with ioutil.ReadDir, not walked
+// recursively, so patterns only ever see a bare filename with no path
+// separator (e.g. "*.bak" or "draft-*.tex"). A pattern written expecting a
+// directory prefix, such as "drafts/**", can never match.
+type scrollFilter struct {
+	include []glob.Glob
+	exclude []glob.Glob
+}
+
+// newScrollFilter compiles the glob patterns from Config.IndexerInclude and
+// Config.IndexerExclude once, so they can be reused for every file in the
+// knowledge directory.
+func newScrollFilter() (scrollFilter, error) {
+	include, err := compileGlobs(Config.IndexerInclude)
+	if err != nil {
+		return scrollFilter{}, errors.Wrap(err, "compile IndexerInclude")
+	}
+	exclude, err := compileGlobs(Config.IndexerExclude)
+	if err != nil {
+		return scrollFilter{}, errors.Wrap(err, "compile IndexerExclude")
+	}
+	return scrollFilter{include, exclude}, nil
+}
+
+func compileGlobs(patterns string) ([]glob.Glob, error) {
+	var globs []glob.Glob
+	for _, pattern := range strings.Split(patterns, ",") {
+		pattern = strings.TrimSpace(pattern)
+		if pattern == "" {
+			continue
+		}
+		if strings.ContainsRune(pattern, '/') {
+			// Matching only ever sees file.Name() (see the scrollFilter doc
+			// comment), so a pattern containing a path separator, such as
+			// "drafts/**", can never match anything. Reject it here instead
+			// of silently shipping a filter that can't do what it looks like
+			// it does.
+			return nil, errors.Errorf("pattern %q contains a path separator, but patterns only match bare filenames", pattern)
+		}
+		g, err := glob.Compile(pattern, '/')
 		if err != nil {
-			logError(err)
+			return nil, errors.Wrapf(err, "compile glob %q", pattern)
 		}
+		globs = append(globs, g)
 	}
-	return index.Batch(batch)
+	return globs, nil
 }
 
-func recordIndexUpdateStart(indexUpdateFile string) {
-	err := touch(indexUpdateFile)
-	tryLogError(err)
+// allows reports whether file should be indexed/rendered: it must be within
+// Config.MaxFileSize, match one of the include globs (if any are set) and
+// match none of the exclude globs. Matching is against file.Name() alone
+// (see the scrollFilter doc comment), so only flat, same-directory patterns
+// are supported.
+func (f scrollFilter) allows(file os.FileInfo) bool {
+	if Config.MaxFileSize > 0 && file.Size() > Config.MaxFileSize {
+		return false
+	}
+
+	name := file.Name()
+	if len(f.include) > 0 {
+		included := false
+		for _, g := range f.include {
+			if g.Match(name) {
+				included = true
+				break
+			}
+		}
+		if !included {
+			return false
+		}
+	}
+
+	for _, g := range f.exclude {
+		if g.Match(name) {
+			return false
+		}
+	}
+
+	return true
 }
 
 func touch(file string) error {
-	now := time.Now()
-	return os.Chtimes(file, now, now)
+	return touchAt(file, time.Now())
+}
+
+func touchAt(file string, t time.Time) error {
+	return os.Chtimes(file, t, t)
 }
 
+// indexMappingVersion identifies the shape of the DocumentMapping
+// createNewIndex builds. Bump it whenever that mapping changes in a way
+// existing documents need reindexing for (a field's analyzer changes, or a
+// field is added/removed) -- e.g. it moved from "1" to "2" when per-language
+// content_<lang> fields replaced the single English-only "content" field.
+// openOrCreateIndex compares it against the version stamped on disk so a
+// pre-existing index built with an older mapping gets rebuilt from scratch
+// instead of silently missing the new fields forever.
+const indexMappingVersion = "2"
+
+const indexMappingVersionKey = "alexandria_mapping_version"
+
 func openOrCreateIndex() (bleve.Index, bool, error) {
 	isNewIndex := false
 
 	index, err := openExistingIndex()
+	if err == nil && !indexMappingUpToDate(index) {
+		tryLogError(index.Close())
+		tryLogError(os.RemoveAll(Config.AlexandriaDirectory + "bleve"))
+		err = errors.New("index mapping is outdated")
+	}
 	if err != nil {
 		index, err = createNewIndex()
 		isNewIndex = true
 	}
+	if err == nil {
+		tryLogError(index.SetInternal([]byte(indexMappingVersionKey), []byte(indexMappingVersion)))
+	}
 
 	return index, isNewIndex, err
 }
 
+// indexMappingUpToDate reports whether index was built with the current
+// indexMappingVersion. Indices created before this field existed read back
+// as an empty version, which correctly compares as out of date.
+func indexMappingUpToDate(index bleve.Index) bool {
+	version, err := index.GetInternal([]byte(indexMappingVersionKey))
+	tryLogError(err)
+	return string(version) == indexMappingVersion
+}
+
 func openExistingIndex() (bleve.Index, error) {
 	return bleve.Open(Config.AlexandriaDirectory + "bleve")
 }
@@ -103,12 +419,32 @@ func createNewIndex() (bleve.Index, error) {
 
 	scrollMapping := bleve.NewDocumentMapping()
 	scrollMapping.AddFieldMappingsAt("id", simpleMapping)
-	scrollMapping.AddFieldMappingsAt("content", enTextMapping)
 	scrollMapping.AddFieldMappingsAt("type", typeMapping)
 	scrollMapping.AddFieldMappingsAt("source", enTextMapping)
 	scrollMapping.AddFieldMappingsAt("tag", enTextMapping)
 	scrollMapping.AddFieldMappingsAt("hidden", enTextMapping)
 	scrollMapping.AddFieldMappingsAt("other", enTextMapping)
+	scrollMapping.AddFieldMappingsAt("language", typeMapping)
+
+	// Index scroll content once per supported language, so e.g. a German
+	// scroll gets German stemming and stop words instead of being forced
+	// through the English analyzer. Each variant reads from the same
+	// "content" property but is stored under its own field name.
+	//
+	// IncludeInAll is turned off on all of them: translatePlusMinusTildePrefixes
+	// already queries content_<lang> directly for the query's detected
+	// language, so merging every variant into "_all" as well would just
+	// index each scroll's content up to len(supportedLanguages) times over
+	// and skew "_all"-based relevance scoring with duplicated term counts.
+	contentMappings := make([]*mapping.FieldMapping, len(supportedLanguages))
+	for i, lang := range supportedLanguages {
+		fm := bleve.NewTextFieldMapping()
+		fm.Name = "content_" + lang
+		fm.Analyzer = lang
+		fm.IncludeInAll = false
+		contentMappings[i] = fm
+	}
+	scrollMapping.AddFieldMappingsAt("content", contentMappings...)
 
 	mapping := bleve.NewIndexMapping()
 	mapping.DefaultAnalyzer = "en"
@@ -131,6 +467,7 @@ func loadAndParseScrollContent(id string, file os.FileInfo) (Scroll, error) {
 	tryLogError(err)
 	content := string(contentBytes)
 	scroll := parse(id, content)
+	scroll.Language = detectLanguage(scroll.Content)
 	return scroll, err
 }
 
@@ -140,6 +477,7 @@ func loadAndParseScrollContentByID(id ID) (Scroll, error) {
 		return Scroll{}, err
 	}
 	scroll := parse(string(id), content)
+	scroll.Language = detectLanguage(scroll.Content)
 	return scroll, nil
 }
 
@@ -154,29 +492,22 @@ func removeFromIndex(id ID) error {
 	return index.Delete(string(id))
 }
 
-// FindScrolls computes a list of scrolls matching the query.
-func findScrolls(query string) (Results, error) {
-	results, err := searchBleve(query)
+// FindScrolls computes a page of scrolls matching the query, starting at
+// result index `from` and containing at most `size` hits. Only the scrolls
+// that make up the requested page are rendered; callers can fetch the next
+// page by calling FindScrolls again with `from += size` until Results.HasMore
+// is false.
+func findScrolls(query string, from, size int) (Results, error) {
+	results, err := searchBleve(query, from, size)
 	if err != nil {
 		return Results{}, err
 	}
-	var x xelatexImagemagickRenderer
-	n := renderListOfScrolls(results.IDs, x)
-	ids := make([]Scroll, n)
-	i := 0
-	for _, id := range results.IDs {
-		if _, err := os.Stat(Config.KnowledgeDirectory + string(id.ID) + ".tex"); os.IsNotExist(err) {
-			continue
-		}
-		ids[i] = Scroll{ID: id.ID}
-		i++
-	}
-	results.Total = n // The number of hits can be wrong if scrolls have been deleted
+	renderListOfScrolls(results.IDs)
 
 	return results, nil
 }
 
-func searchBleve(queryString string) (Results, error) {
+func searchBleve(queryString string, from, size int) (Results, error) {
 	index, err := openExistingIndex()
 	if err != nil {
 		logError(err)
@@ -185,7 +516,7 @@ func searchBleve(queryString string) (Results, error) {
 	defer index.Close()
 
 	newQueryString := translatePlusMinusTildePrefixes(queryString)
-	searchResults, err := performQuery(index, newQueryString)
+	searchResults, err := performQuery(index, newQueryString, from, size)
 	if err != nil {
 		if err.Error() == "syntax error" {
 			log.Printf("Invalid query string: '%v'", newQueryString)
@@ -195,8 +526,13 @@ func searchBleve(queryString string) (Results, error) {
 	}
 
 	scrolls := loadMatchingScrolls(searchResults)
+	total := int(searchResults.Total)
 
-	return Results{scrolls[:len(searchResults.Hits)], int(searchResults.Total)}, nil
+	return Results{
+		IDs:     scrolls[:len(searchResults.Hits)],
+		Total:   total,
+		HasMore: from+len(searchResults.Hits) < total,
+	}, nil
 }
 
 // Bleve's query language allows terms with different prefixes.  Terms starting
@@ -208,26 +544,64 @@ func searchBleve(queryString string) (Results, error) {
 // in front of every term.  Therefore, Alexandria's query language
 // automatically adds a plus in front of terms that have neither a plus nor
 // minus prefix.  To make a term optional, it can be prefixed with a ~.
+//
+// A term may also be prefixed with `lang:xx:` to restrict it to the content
+// variant indexed for language xx, e.g. `lang:de:Wort` only matches Wort
+// against German scrolls instead of every language's content field.
+//
+// Plain terms (no +/-/~/lang: prefix) are required to match content_<lang>
+// for the query's own detected language, rather than the unqualified "_all"
+// field: content_<lang> is not copied into "_all" (see createNewIndex), and
+// an unqualified term is analyzed with the index's default ("en") analyzer
+// no matter which field it ends up matching against, so a German query term
+// would never benefit from German stemming if it only had to match "_all".
+// The plain word is still added back in unprefixed (optional) form so it can
+// also match -- and boost the score of -- tag/source/hidden/other, which do
+// stay in "_all".
 func translatePlusMinusTildePrefixes(queryString string) string {
+	lang := detectLanguage(queryString)
+
 	newQueryString := ""
 	for _, tmp := range strings.Split(queryString, " ") {
 		word := strings.TrimSpace(tmp)
-		if word[0] == '-' || word[0] == '+' {
+		if word == "" {
+			continue
+		}
+		if strings.HasPrefix(word, "lang:") {
+			newQueryString += " +" + translateLangPrefix(word)
+		} else if word[0] == '-' || word[0] == '+' {
 			newQueryString += " " + word
 		} else if word[0] == '~' {
 			// Remove prefix to make term optional
 			newQueryString += " " + word[1:]
 		} else {
-			newQueryString += " +" + word
+			newQueryString += " +content_" + lang + ":" + word + " " + word
 		}
 	}
 	return newQueryString[1:] // Remove leading space
 }
 
-func performQuery(index bleve.Index, newQueryString string) (*bleve.SearchResult, error) {
+// translateLangPrefix turns the `lang:xx:term` shorthand into a query
+// targeting that language's content field, e.g. `lang:de:Wort` becomes
+// `content_de:Wort`. Terms that don't follow the shorthand are returned
+// unchanged.
+func translateLangPrefix(word string) string {
+	rest := strings.TrimPrefix(word, "lang:")
+	parts := strings.SplitN(rest, ":", 2)
+	if len(parts) != 2 {
+		return word
+	}
+	return "content_" + parts[0] + ":" + parts[1]
+}
+
+func performQuery(index bleve.Index, newQueryString string, from, size int) (*bleve.SearchResult, error) {
 	query := bleve.NewQueryStringQuery(newQueryString)
 	search := bleve.NewSearchRequest(query)
-	search.Size = Config.MaxResults
+	search.From = from
+	search.Size = size
+	if Config.HighlightResults {
+		search.Highlight = bleve.NewHighlightWithStyle("html")
+	}
 	return index.Search(search)
 }
 
@@ -240,6 +614,7 @@ func loadMatchingScrolls(searchResults *bleve.SearchResult) []Scroll {
 			logError(err)
 			continue
 		}
+		scroll.Snippets = match.Fragments
 		scrolls = append(scrolls, scroll)
 	}
 
@@ -266,4 +641,4 @@ func computeStatistics() (Statistics, error) {
 	}
 
 	return Stats{int(num), size}, nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,62 @@
+// This file is part of Alexandria which is released under AGPLv3.
+// Copyright (C) 2015-2018 Colin Benner
+// See LICENSE or go to https://github.com/yzhs/alexandria/LICENSE for full
+// license details.
+
+package alexandria
+
+import "testing"
+
+func TestDetectLanguage(t *testing.T) {
+	cases := []struct {
+		content string
+		want    string
+	}{
+		{"The quick fox jumps over the lazy dog and it is great", "en"},
+		{"Der Hund und die Katze sind nicht von dieser Welt, das ist mit Sicherheit klar", "de"},
+		{"Le chat et le chien sont dans la maison pour les vacances", "fr"},
+		{"", "en"},
+	}
+
+	for _, c := range cases {
+		if got := detectLanguage(c.content); got != c.want {
+			t.Errorf("detectLanguage(%q) = %q, want %q", c.content, got, c.want)
+		}
+	}
+}
+
+// TestTranslatePlusMinusTildePrefixesTargetsDetectedLanguage covers the
+// default, non-lang-prefixed search path across a mixed-language library: a
+// query written in German should end up requiring a match against
+// content_de directly, not just the English-analyzed "_all" field.
+func TestTranslatePlusMinusTildePrefixesTargetsDetectedLanguage(t *testing.T) {
+	query := "ist nicht mit Hund"
+	got := translatePlusMinusTildePrefixes(query)
+	want := "+content_de:ist ist +content_de:nicht nicht +content_de:mit mit +content_de:Hund Hund"
+	if got != want {
+		t.Errorf("translatePlusMinusTildePrefixes(%q) = %q, want %q", query, got, want)
+	}
+}
+
+func TestTranslatePlusMinusTildePrefixesLangShorthandUnaffected(t *testing.T) {
+	got := translatePlusMinusTildePrefixes("lang:fr:chat")
+	want := "+content_fr:chat"
+	if got != want {
+		t.Errorf("translatePlusMinusTildePrefixes(%q) = %q, want %q", "lang:fr:chat", got, want)
+	}
+}
+
+// TestNewScrollFilterRejectsPathSeparatorPatterns covers a directory-style
+// pattern, drafts/**: since matching only ever sees a bare filename (see the
+// scrollFilter doc comment), such a pattern can never match anything, so
+// newScrollFilter must reject it loudly instead of silently compiling a
+// no-op filter.
+func TestNewScrollFilterRejectsPathSeparatorPatterns(t *testing.T) {
+	old := Config.IndexerExclude
+	defer func() { Config.IndexerExclude = old }()
+
+	Config.IndexerExclude = "drafts/**"
+	if _, err := newScrollFilter(); err == nil {
+		t.Error("newScrollFilter with a path-separator pattern should fail, got nil error")
+	}
+}
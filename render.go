@@ -61,13 +61,15 @@ type latexToPngRenderer interface {
 	err() error
 }
 
-// xelatexImagemagickRenderer uses xelatex to handle the LaTeX-to-PDF
-// translation, ImageMagick to convert the PDF to a PNG.
+// xelatexImagemagickRenderer drives either xelatex or lualatex to handle the
+// LaTeX-to-PDF translation, and ImageMagick to convert the PDF to a PNG. The
+// engine defaults to "xelatex" when left blank.
 type xelatexImagemagickRenderer struct {
-	error error
+	engine string
+	error  error
 }
 
-func (x xelatexImagemagickRenderer) scrollToLatex(id ID) {
+func (x *xelatexImagemagickRenderer) scrollToLatex(id ID) {
 	var e errTemplateReader
 
 	scrollText, err := readScroll(id)
@@ -99,18 +101,23 @@ func (x xelatexImagemagickRenderer) scrollToLatex(id ID) {
 	x.error = errors.Wrapf(err, "writing latex file %v.tex to temporary directory", id)
 }
 
-func (x xelatexImagemagickRenderer) latexToPdf(id ID) {
+func (x *xelatexImagemagickRenderer) latexToPdf(id ID) {
 	if x.error != nil {
 		return
 	}
 
-	msg, err := exec.Command("xelatex", "-interaction", "nonstopmode",
+	engine := x.engine
+	if engine == "" {
+		engine = "xelatex"
+	}
+
+	msg, err := exec.Command(engine, "-interaction", "nonstopmode",
 		"-output-directory", Config.TempDirectory,
 		Config.TempDirectory+string(id)).CombinedOutput()
-	x.error = errors.Wrapf(err, "XeLaTeX build: %v", msg)
+	x.error = errors.Wrapf(err, "%v build: %v", engine, msg)
 }
 
-func (x xelatexImagemagickRenderer) pdfToPng(i ID) {
+func (x *xelatexImagemagickRenderer) pdfToPng(i ID) {
 	if x.error != nil {
 		return
 	}
@@ -123,7 +130,19 @@ func (x xelatexImagemagickRenderer) pdfToPng(i ID) {
 
 }
 
-func (x xelatexImagemagickRenderer) deleteTemporaryFiles(id ID) {
+func (x *xelatexImagemagickRenderer) deleteTemporaryFiles(id ID) {
+	deleteGlob(id)
+}
+
+func (x *xelatexImagemagickRenderer) err() error {
+	return x.error
+}
+
+// deleteGlob removes every temporary file belonging to id, regardless of
+// extension. This is shared by all latexToPngRenderer implementations since
+// each LaTeX engine leaves behind a different set of auxiliary files (e.g.
+// xelatex's .aux/.log versus ConTeXt's .tuc/.synctex.gz).
+func deleteGlob(id ID) {
 	files, err := filepath.Glob(Config.TempDirectory + string(id) + ".*")
 	if err != nil {
 		logError(err)
@@ -134,8 +153,126 @@ func (x xelatexImagemagickRenderer) deleteTemporaryFiles(id ID) {
 	}
 }
 
-func (x xelatexImagemagickRenderer) err() error {
-	return x.error
+// contextRenderer drives ConTeXt (MkIV) to handle the LaTeX-to-PDF
+// translation. It benefits scrolls that rely on MkIV features such as
+// OpenType math or MetaPost inclusion, and serves as a fallback when
+// ImageMagick's PDF policy is locked down, since the PDF-to-PNG step is done
+// with mutool or pdftoppm instead of convert.
+type contextRenderer struct {
+	// pdfToPngTool selects the PDF->PNG backend: "mutool" or "pdftoppm".
+	// Defaults to "mutool" when left blank.
+	pdfToPngTool string
+	error        error
+}
+
+func (c *contextRenderer) scrollToLatex(id ID) {
+	var e errTemplateReader
+
+	scrollText, err := readScroll(id)
+	if err != nil {
+		if os.IsNotExist(err) {
+			err = removeFromIndex(id)
+			if err != nil {
+				logError(err)
+			}
+			c.error = ErrNoSuchScroll
+			return
+		}
+		c.error = err
+		return
+	}
+	scroll := parse(string(id), scrollText)
+
+	e.readTemplate("header")
+	e.readTemplate(scroll.Type + "_header")
+	e.doc += scroll.Content
+	e.readTemplate(scroll.Type + "_footer")
+	e.readTemplate("footer")
+
+	if e.err != nil {
+		c.error = errors.Wrapf(e.err, "producing latex file for scroll %v", id)
+		return
+	}
+	err = writeTemp(id, e.doc)
+	c.error = errors.Wrapf(err, "writing latex file %v.tex to temporary directory", id)
+}
+
+func (c *contextRenderer) latexToPdf(id ID) {
+	if c.error != nil {
+		return
+	}
+
+	msg, err := exec.Command("context", "--batchmode", "--purgeall",
+		"--result="+Config.TempDirectory+string(id)+".pdf",
+		Config.TempDirectory+string(id)+".tex").CombinedOutput()
+	c.error = errors.Wrapf(err, "ConTeXt build: %v", msg)
+}
+
+func (c *contextRenderer) pdfToPng(i ID) {
+	if c.error != nil {
+		return
+	}
+
+	id := string(i)
+	pdf := Config.TempDirectory + id + ".pdf"
+	png := Config.CacheDirectory + id + ".png"
+
+	tool := c.pdfToPngTool
+	if tool == "" {
+		tool = "mutool"
+	}
+
+	switch tool {
+	case "pdftoppm":
+		c.error = exec.Command("pdftoppm", "-png", "-r", strconv.Itoa(Config.Dpi),
+			"-singlefile", pdf, Config.CacheDirectory+id).Run()
+	default:
+		c.error = exec.Command("mutool", "draw", "-o", png,
+			"-r", strconv.Itoa(Config.Dpi), pdf).Run()
+	}
+}
+
+func (c *contextRenderer) deleteTemporaryFiles(id ID) {
+	deleteGlob(id)
+}
+
+func (c *contextRenderer) err() error {
+	return c.error
+}
+
+// newRenderer picks the latexToPngRenderer backend for the given scroll. A
+// scroll may override Config.Renderer by declaring `%! renderer: context` (or
+// `xelatex`/`lualatex`) on one of its first few lines.
+func newRenderer(id ID) latexToPngRenderer {
+	kind := Config.Renderer
+	if content, err := readScroll(id); err == nil {
+		if k := rendererDirective(content); k != "" {
+			kind = k
+		}
+	}
+
+	switch kind {
+	case "context":
+		return &contextRenderer{pdfToPngTool: Config.PdfToPngTool}
+	case "lualatex":
+		return &xelatexImagemagickRenderer{engine: "lualatex"}
+	default:
+		return &xelatexImagemagickRenderer{engine: "xelatex"}
+	}
+}
+
+// rendererDirective looks for a `%! renderer: <name>` comment among the first
+// few lines of a scroll's raw source, letting individual scrolls pick a
+// non-default rendering backend.
+func rendererDirective(content string) string {
+	lines := strings.SplitN(content, "\n", 5)
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "%! renderer:") {
+			return strings.TrimSpace(strings.TrimPrefix(line, "%! renderer:"))
+		}
+	}
+	return ""
 }
 
 // renderScroll takes a scroll ID and a renderer to create a PNG image from
@@ -153,14 +290,14 @@ func renderScroll(id ID, renderer latexToPngRenderer) error {
 	return errors.Wrap(renderer.err(), "rendering")
 }
 
-// renderListOfScrolls takes a list of scroll IDs and passes them to the given
-// rendering backend.
-func renderListOfScrolls(ids []Scroll, renderer latexToPngRenderer) int {
+// renderListOfScrolls takes a list of scroll IDs and renders each one with
+// the backend it selects via newRenderer.
+func renderListOfScrolls(ids []Scroll) int {
 	numScrolls := 0
 
 	for _, foo := range ids {
 		id := foo.ID
-		err := renderScroll(id, renderer)
+		err := renderScroll(id, newRenderer(id))
 		if err != nil {
 			if err == ErrNoSuchScroll {
 				continue
@@ -178,11 +315,15 @@ func renderListOfScrolls(ids []Scroll, renderer latexToPngRenderer) int {
 // renderAllScrolls goes through the library directory and renders every
 // available scroll.  This allows us to perform all the expensive LaTeX-to-PDF
 // conversions ahead-of-time, so queries can be answered more quickly.
-func renderAllScrolls(renderer latexToPngRenderer) int {
+func renderAllScrolls() int {
 	files, err := ioutil.ReadDir(Config.KnowledgeDirectory)
 	if err != nil {
 		panic(err)
 	}
+	filter, err := newScrollFilter()
+	if err != nil {
+		panic(err)
+	}
 	var errors []error
 	limitGoroutines := make(chan bool, Config.MaxProcs)
 	for i := 0; i < Config.MaxProcs; i++ {
@@ -192,12 +333,12 @@ func renderAllScrolls(renderer latexToPngRenderer) int {
 	for _, file := range files {
 		go func(file os.FileInfo) {
 			<-limitGoroutines
-			if !strings.HasSuffix(file.Name(), ".tex") {
+			if !strings.HasSuffix(file.Name(), ".tex") || !filter.allows(file) {
 				ch <- 0
 				return
 			}
 			id := ID(strings.TrimSuffix(file.Name(), ".tex"))
-			if err := renderScroll(id, renderer); err != nil && err != ErrNoSuchScroll {
+			if err := renderScroll(id, newRenderer(id)); err != nil && err != ErrNoSuchScroll {
 				log.Printf("%s\nERROR\n%s\n%v\n%s\n", hashes, hashes, err, hashes)
 			}
 			ch <- 1
@@ -212,4 +353,4 @@ func renderAllScrolls(renderer latexToPngRenderer) int {
 		log.Printf("Error: %v\n", err)
 	}
 	return counter
-}
\ No newline at end of file
+}